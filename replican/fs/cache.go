@@ -0,0 +1,114 @@
+package fs
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+// CachingBlockStore decorates any BlockStore with a size-bounded, in-memory
+// LRU cache keyed by strong checksum. Sync workloads tend to request the
+// same blocks repeatedly -- especially when many small edits reference
+// nearby blocks -- so serving hits from memory avoids a disk round-trip
+// through the wrapped store's ReadBlock.
+type CachingBlockStore struct {
+	BlockStore
+
+	capacity int64
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	order   *list.List
+	hits    int64
+	misses  int64
+}
+
+type blockCacheEntry struct {
+	strong string
+	data   []byte
+}
+
+// NewCachingBlockStore wraps store with an LRU cache bounded to capacity
+// bytes of block payloads, not entry count.
+func NewCachingBlockStore(store BlockStore, capacity int64) *CachingBlockStore {
+	return &CachingBlockStore{
+		BlockStore: store,
+		capacity:   capacity,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// CacheStats reports hit/miss counters and current occupancy, for
+// observability.
+type CacheStats struct {
+	Hits, Misses   int64
+	Size, Capacity int64
+}
+
+func (cache *CachingBlockStore) Stats() CacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return CacheStats{Hits: cache.hits, Misses: cache.misses, Size: cache.size, Capacity: cache.capacity}
+}
+
+// ReadBlock serves strong from the cache when present, otherwise delegates
+// to the wrapped store and populates the cache with the result.
+func (cache *CachingBlockStore) ReadBlock(strong string) ([]byte, error) {
+	if data, ok := cache.get(strong); ok {
+		return data, nil
+	}
+
+	data, err := cache.BlockStore.ReadBlock(strong)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.put(strong, data)
+	return data, nil
+}
+
+// ReadInto is not cached: a ranged file read rarely aligns with a single
+// whole block, so the cache only sits in front of ReadBlock and ReadInto
+// passes straight through to the wrapped store.
+func (cache *CachingBlockStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, error) {
+	return cache.BlockStore.ReadInto(strong, from, length, writer)
+}
+
+func (cache *CachingBlockStore) get(strong string) ([]byte, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	elem, ok := cache.entries[strong]
+	if !ok {
+		cache.misses++
+		return nil, false
+	}
+
+	cache.order.MoveToFront(elem)
+	cache.hits++
+	return elem.Value.(*blockCacheEntry).data, true
+}
+
+func (cache *CachingBlockStore) put(strong string, data []byte) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if _, exists := cache.entries[strong]; exists {
+		return
+	}
+
+	elem := cache.order.PushFront(&blockCacheEntry{strong: strong, data: data})
+	cache.entries[strong] = elem
+	cache.size += int64(len(data))
+
+	for cache.size > cache.capacity && cache.order.Len() > 0 {
+		oldest := cache.order.Back()
+		entry := oldest.Value.(*blockCacheEntry)
+		cache.order.Remove(oldest)
+		delete(cache.entries, entry.strong)
+		cache.size -= int64(len(entry.data))
+	}
+}
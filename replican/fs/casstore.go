@@ -0,0 +1,459 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	casBlockDir   = "block"
+	casNodeDir    = "node"
+	casTempPrefix = "_castmp"
+)
+
+// CASStore is a BlockStore backed by a content-addressable layout on disk:
+// block payloads live under <root>/block/<xx>/<strong> (sharded by the
+// first two hex characters of the strong checksum) and filesystem nodes are
+// serialized with the store's NodeCodec (GobCodec unless Options.Codec says
+// otherwise) under <root>/node/<xx>/<strong>, referencing their blocks by
+// strong checksum only. Unlike LocalDirStore, which indexes a live
+// directory tree in place, a CASStore is itself the store: Put copies a
+// source tree in, deduplicating any block whose content already exists
+// regardless of which file originally contributed it, and the resulting
+// on-disk layout is safe for concurrent writers since every write lands via
+// write-to-temp-then-rename. root and index are in-memory state Put swaps in
+// after a successful write, guarded by mu so a Root/Index/ReadBlock call
+// racing a Put never observes a torn update.
+type CASStore struct {
+	mu sync.Mutex
+
+	rootPath    string
+	root        FsNode
+	index       *BlockIndex
+	chunkers    ChunkerFactory
+	compression Compressor
+	codec       NodeCodec
+}
+
+// NewCASStore opens (creating if necessary) a CASStore rooted at rootPath.
+func NewCASStore(rootPath string) (store *CASStore, err error) {
+	return NewCASStoreWithOptions(rootPath, Options{})
+}
+
+// NewCASStoreWithOptions builds a CASStore the same way NewCASStore does,
+// but lets the caller configure optional behavior such as per-block
+// compression.
+func NewCASStoreWithOptions(rootPath string, options Options) (store *CASStore, err error) {
+	for _, dir := range []string{casBlockDir, casNodeDir} {
+		if err = os.MkdirAll(filepath.Join(rootPath, dir), 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	compression := options.Compression
+	if compression == nil {
+		compression = NoCompression{}
+	}
+
+	codec := options.Codec
+	if codec == nil {
+		codec = GobCodec{}
+	}
+
+	chunkers := options.Chunker
+	if chunkers == nil {
+		chunkers = func() Chunker { return NewDefaultCDCChunker() }
+	}
+
+	store = &CASStore{
+		rootPath:    rootPath,
+		chunkers:    chunkers,
+		compression: compression,
+		codec:       codec,
+	}
+	return store, nil
+}
+
+func (store *CASStore) Root() FsNode {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.root
+}
+
+func (store *CASStore) Index() *BlockIndex {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.index
+}
+
+func casShardPath(base, strong string) string {
+	shard := strong
+	if len(shard) > 2 {
+		shard = shard[:2]
+	}
+	return filepath.Join(base, shard, strong)
+}
+
+func (store *CASStore) blockPath(strong string) string {
+	return casShardPath(filepath.Join(store.rootPath, casBlockDir), strong)
+}
+
+func (store *CASStore) nodePath(strong string) string {
+	return casShardPath(filepath.Join(store.rootPath, casNodeDir), strong)
+}
+
+// writeAtomic writes data to path by writing a temp file in the same
+// directory and renaming it into place, so a concurrent reader never
+// observes a partially-written block or node.
+func writeAtomic(path string, data []byte) (err error) {
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, casTempPrefix)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (store *CASStore) hasBlock(strong string) bool {
+	_, err := os.Stat(store.blockPath(strong))
+	return err == nil
+}
+
+// putBlock writes the block payload to the store unless it's already
+// present, so identical blocks contributed by different files are only
+// ever stored once. The payload is compressed with the store's Compressor
+// and prefixed with a header recording the codec and uncompressed length,
+// so a store can mix codecs across blocks and stay self-describing on read.
+func (store *CASStore) putBlock(content []byte) (strong string, err error) {
+	sum := sha1.Sum(content)
+	strong = hex.EncodeToString(sum[:])
+
+	if store.hasBlock(strong) {
+		return strong, nil
+	}
+
+	buf := &bytes.Buffer{}
+	if err = writeBlockHeader(buf, store.compression.Magic(), int64(len(content))); err != nil {
+		return "", err
+	}
+
+	encoder := store.compression.Encode(buf)
+	if _, err = encoder.Write(content); err != nil {
+		return "", err
+	}
+	if err = encoder.Close(); err != nil {
+		return "", err
+	}
+
+	return strong, writeAtomic(store.blockPath(strong), buf.Bytes())
+}
+
+// Put walks the tree rooted at path, chunks each file with the store's
+// ChunkerFactory, writes any block the store doesn't already have, and
+// writes a node record for every file and directory encountered. The
+// returned FsNode becomes the store's Root when path is the top-level call.
+func (store *CASStore) Put(path string) (node FsNode, err error) {
+	rootInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if rootInfo.IsDirectory() {
+		node, err = store.putDir(path)
+	} else if rootInfo.IsRegular() {
+		node, err = store.putFile(path)
+	} else {
+		return nil, errors.New(fmt.Sprintf("Cannot put %s: neither a file nor a directory", path))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	store.mu.Lock()
+	store.root = node
+	store.index = IndexBlocks(node)
+	store.mu.Unlock()
+
+	return node, nil
+}
+
+func (store *CASStore) putFile(path string) (file *File, err error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	file = &File{name: filepath.Base(path), mode: info.Mode(), Size: info.Size()}
+
+	chunker := store.chunkers()
+	hasher := sha1.New()
+	var position int64
+
+	for {
+		chunk, cerr := chunker.Next(fh)
+		if len(chunk) > 0 {
+			strong, perr := store.putBlock(chunk)
+			if perr != nil {
+				return nil, perr
+			}
+
+			block := &Block{position: position, length: int64(len(chunk)), weak: rollingHash(chunk), strong: strong, parent: file}
+			file.Blocks = append(file.Blocks, block)
+
+			hasher.Write(chunk)
+			position += int64(len(chunk))
+		}
+
+		if cerr == io.EOF {
+			break
+		}
+		if cerr != nil {
+			return nil, cerr
+		}
+	}
+
+	file.strong = hex.EncodeToString(hasher.Sum(nil))
+
+	if err = store.putNode(file.strong, file); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (store *CASStore) putDir(path string) (dir *Dir, err error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dir = &Dir{name: filepath.Base(path), mode: info.Mode()}
+	hasher := sha1.New()
+
+	for _, entry := range entries {
+		childPath := filepath.Join(path, entry.Name())
+
+		if entry.IsDirectory() {
+			child, cerr := store.putDir(childPath)
+			if cerr != nil {
+				return nil, cerr
+			}
+			child.parent = dir
+			dir.SubDirs = append(dir.SubDirs, child)
+			fmt.Fprint(hasher, child.Strong())
+		} else {
+			child, cerr := store.putFile(childPath)
+			if cerr != nil {
+				return nil, cerr
+			}
+			child.parent = dir
+			dir.Files = append(dir.Files, child)
+			fmt.Fprint(hasher, child.Strong())
+		}
+	}
+
+	dir.strong = hex.EncodeToString(hasher.Sum(nil))
+
+	if err = store.putNode(dir.strong, dir); err != nil {
+		return nil, err
+	}
+
+	return dir, nil
+}
+
+// putNode serializes node with the store's NodeCodec and writes it under
+// strong, so Compact and a future peer reading this store's node/ directory
+// can recognize which codec produced it (see DecodeFile/DecodeDir).
+func (store *CASStore) putNode(strong string, node FsNode) error {
+	var data []byte
+	var err error
+
+	switch n := node.(type) {
+	case *File:
+		data, err = EncodeFileWith(store.codec, n)
+	case *Dir:
+		data, err = EncodeDirWith(store.codec, n)
+	default:
+		return errors.New(fmt.Sprintf("putNode: unsupported node type %T", node))
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeAtomic(store.nodePath(strong), data)
+}
+
+// ReadBlock returns the decompressed bytes of the block with the given
+// strong checksum.
+func (store *CASStore) ReadBlock(strong string) ([]byte, error) {
+	raw, err := ioutil.ReadFile(store.blockPath(strong))
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Block with strong checksum %s not found", strong))
+	}
+
+	buf := bytes.NewReader(raw)
+	codec, _, hasHeader, err := readBlockHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if !hasHeader {
+		return raw, nil
+	}
+
+	compression, err := compressorForCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := compression.Decode(buf)
+	defer decoder.Close()
+
+	return ioutil.ReadAll(decoder)
+}
+
+// Get streams the file with the given strong checksum to w by concatenating
+// its blocks in order.
+func (store *CASStore) Get(strong string, w io.Writer) error {
+	file, has := store.Index().StrongFile(strong)
+	if !has {
+		return errors.New(fmt.Sprintf("File with strong checksum %s not found", strong))
+	}
+
+	for _, block := range file.Blocks {
+		data, err := store.ReadBlock(block.Strong())
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadInto implements BlockStore by reading only the blocks overlapping the
+// requested [from, from+length) range, unlike Get, which streams the whole
+// file.
+func (store *CASStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (written int64, err error) {
+	file, has := store.Index().StrongFile(strong)
+	if !has {
+		return 0, errors.New(fmt.Sprintf("File with strong checksum %s not found", strong))
+	}
+
+	if from > file.Size {
+		return 0, errors.New(fmt.Sprintf("Read offset %d past end of file (len %d)", from, file.Size))
+	}
+
+	end := from + length
+	if end > file.Size {
+		end = file.Size
+	}
+
+	for _, block := range file.Blocks {
+		blockStart := block.Offset()
+		blockEnd := blockStart + block.Length()
+
+		if blockEnd <= from || blockStart >= end {
+			continue
+		}
+
+		data, rerr := store.ReadBlock(block.Strong())
+		if rerr != nil {
+			return written, rerr
+		}
+
+		sliceStart := int64(0)
+		if from > blockStart {
+			sliceStart = from - blockStart
+		}
+		sliceEnd := int64(len(data))
+		if end < blockEnd {
+			sliceEnd = end - blockStart
+		}
+
+		n, werr := writer.Write(data[sliceStart:sliceEnd])
+		written += int64(n)
+		if werr != nil {
+			return written, werr
+		}
+	}
+
+	return written, nil
+}
+
+// Compact removes every block under <root>/block that isn't referenced by
+// any node under <root>/node, reclaiming space held by blocks whose files
+// have since been overwritten with different content.
+func (store *CASStore) Compact() error {
+	referenced := make(map[string]bool)
+
+	walkErr := filepath.Walk(filepath.Join(store.rootPath, casNodeDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDirectory() {
+			return err
+		}
+
+		data, rerr := ioutil.ReadFile(path)
+		if rerr != nil {
+			return rerr
+		}
+
+		if file, derr := DecodeFile(data); derr == nil {
+			for _, block := range file.Blocks {
+				referenced[block.Strong()] = true
+			}
+		}
+
+		return nil
+	})
+	if walkErr != nil {
+		return walkErr
+	}
+
+	return filepath.Walk(filepath.Join(store.rootPath, casBlockDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDirectory() {
+			return err
+		}
+
+		if !referenced[filepath.Base(path)] {
+			return os.Remove(path)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,128 @@
+package fs
+
+import "io"
+
+// Default target sizes for CDCChunker, in bytes.
+const (
+	cdcDefaultMin = 64 * 1024
+	cdcDefaultAvg = 512 * 1024
+	cdcDefaultMax = 4 * 1024 * 1024
+
+	// cdcWindowSize is the number of trailing bytes the rolling hash is
+	// computed over when deciding a chunk boundary.
+	cdcWindowSize = 64
+)
+
+// Chunker decides where a file's content should be split into Blocks.
+// IndexFile calls Next repeatedly until the underlying reader is exhausted;
+// each returned slice becomes the content of one Block.
+type Chunker interface {
+	// Next reads from r and returns the bytes of the next chunk. It returns
+	// io.EOF once r is exhausted and there is no further chunk to return.
+	Next(r io.Reader) (chunk []byte, err error)
+}
+
+// ChunkerFactory builds a fresh Chunker for each file IndexFile processes,
+// so per-file chunker state (such as CDCChunker's rolling hash) never leaks
+// between files.
+type ChunkerFactory func() Chunker
+
+// FixedChunker splits a file into equal-sized BLOCKSIZE chunks, reproducing
+// the historical behavior of IndexFile. It's the ChunkerFactory used when
+// callers don't ask for content-defined chunking.
+type FixedChunker struct {
+	size int
+}
+
+// NewFixedChunker builds a FixedChunker that cuts BLOCKSIZE-sized chunks.
+func NewFixedChunker() *FixedChunker {
+	return &FixedChunker{size: BLOCKSIZE}
+}
+
+func (c *FixedChunker) Next(r io.Reader) (chunk []byte, err error) {
+	buf := make([]byte, c.size)
+	n, err := io.ReadFull(r, buf)
+	if n == 0 {
+		return nil, err
+	}
+	if err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// CDCChunker implements content-defined chunking: a boundary is declared
+// after the rolling hash of the trailing cdcWindowSize bytes has its low
+// bits (per mask) all zero, which happens on average once every Avg bytes.
+// Because the boundary depends only on recently-seen bytes rather than on
+// the chunk's position in the file, inserting or deleting bytes near the
+// start of a file reshuffles only the chunks adjacent to the edit instead
+// of every block downstream, unlike FixedChunker.
+type CDCChunker struct {
+	Min, Avg, Max int
+	mask          uint32
+}
+
+// NewCDCChunker builds a CDCChunker targeting the given minimum, average and
+// maximum chunk sizes. Avg should be a power of two; the boundary mask is
+// derived from it.
+func NewCDCChunker(min, avg, max int) *CDCChunker {
+	return &CDCChunker{Min: min, Avg: avg, Max: max, mask: uint32(avg - 1)}
+}
+
+// NewDefaultCDCChunker builds a CDCChunker using the package's default
+// chunk size targets (64 KiB min, 512 KiB avg, 4 MiB max).
+func NewDefaultCDCChunker() *CDCChunker {
+	return NewCDCChunker(cdcDefaultMin, cdcDefaultAvg, cdcDefaultMax)
+}
+
+func (c *CDCChunker) Next(r io.Reader) (chunk []byte, err error) {
+	buf := make([]byte, 0, c.Avg)
+	window := make([]byte, 0, cdcWindowSize)
+
+	b := make([]byte, 1)
+	for {
+		n, rerr := r.Read(b)
+		if n == 0 {
+			if rerr != nil {
+				if len(buf) == 0 {
+					return nil, rerr
+				}
+				return buf, nil
+			}
+			continue
+		}
+
+		buf = append(buf, b[0])
+		window = append(window, b[0])
+		if len(window) > cdcWindowSize {
+			window = window[1:]
+		}
+
+		if len(buf) >= c.Min {
+			hash := rollingHash(window)
+			if hash&c.mask == 0 || len(buf) >= c.Max {
+				return buf, nil
+			}
+		}
+
+		if rerr != nil {
+			if rerr == io.EOF {
+				return buf, nil
+			}
+			return buf, rerr
+		}
+	}
+}
+
+// rollingHash computes a 32-bit FNV-1a hash over window. CDCChunker
+// only ever hashes a cdcWindowSize-byte window, so recomputing it from
+// scratch on every byte is cheap relative to the I/O it rides alongside.
+func rollingHash(window []byte) uint32 {
+	const prime uint32 = 16777619
+	var h uint32 = 2166136261
+	for _, b := range window {
+		h = (h ^ uint32(b)) * prime
+	}
+	return h
+}
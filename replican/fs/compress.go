@@ -0,0 +1,176 @@
+package fs
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Compressor encodes and decodes block payloads for a BlockStore. Encode
+// wraps w so writes to the returned WriteCloser end up compressed in the
+// underlying stream; Decode wraps r so reads from the returned ReadCloser
+// yield the original, uncompressed bytes. Magic identifies the Compressor in
+// a block's header the same way NodeCodec.Magic identifies a node's codec,
+// so a custom Compressor registered with RegisterCompressor round-trips
+// through compressorForCodec like any built-in one, instead of silently
+// being written under codecNone.
+type Compressor interface {
+	Magic() byte
+
+	Encode(w io.Writer) io.WriteCloser
+	Decode(r io.Reader) io.ReadCloser
+}
+
+// Codec ids recorded in the per-block header, so a store can mix codecs
+// across blocks and stay self-describing on read.
+const (
+	codecNone byte = iota
+	codecGzip
+	codecZstd
+	codecSnappy
+)
+
+var compressors = map[byte]Compressor{}
+
+// RegisterCompressor makes a Compressor available to compressorForCodec by
+// its Magic byte, so this file's own codecs and any custom Compressor a
+// caller registers are looked up the same way.
+func RegisterCompressor(compressor Compressor) {
+	compressors[compressor.Magic()] = compressor
+}
+
+func init() {
+	RegisterCompressor(NoCompression{})
+	RegisterCompressor(GzipCompression{})
+	RegisterCompressor(ZstdCompression{})
+	RegisterCompressor(Snappy{})
+}
+
+// blockHeaderMagic tags a compressed block payload so a reader can tell a
+// headered block apart from a raw, pre-compression-support one.
+var blockHeaderMagic = [4]byte{'R', 'P', 'C', 'B'}
+
+// writeBlockHeader prepends magic, a 1-byte codec id and the uncompressed
+// length to a block payload being written through a Compressor.
+func writeBlockHeader(w io.Writer, codec byte, uncompressedLen int64) error {
+	if _, err := w.Write(blockHeaderMagic[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{codec}); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, uncompressedLen)
+}
+
+// readBlockHeader reads back what writeBlockHeader wrote. hasHeader is
+// false when the payload doesn't start with blockHeaderMagic, meaning it
+// predates compression support and should be treated as raw bytes.
+func readBlockHeader(r io.Reader) (codec byte, uncompressedLen int64, hasHeader bool, err error) {
+	var magic [4]byte
+	if _, err = io.ReadFull(r, magic[:]); err != nil {
+		return 0, 0, false, err
+	}
+	if magic != blockHeaderMagic {
+		return 0, 0, false, nil
+	}
+
+	var codecBuf [1]byte
+	if _, err = io.ReadFull(r, codecBuf[:]); err != nil {
+		return 0, 0, false, err
+	}
+	if err = binary.Read(r, binary.BigEndian, &uncompressedLen); err != nil {
+		return 0, 0, false, err
+	}
+
+	return codecBuf[0], uncompressedLen, true, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// NoCompression stores block payloads as-is.
+type NoCompression struct{}
+
+func (NoCompression) Magic() byte { return codecNone }
+
+func (NoCompression) Encode(w io.Writer) io.WriteCloser { return nopWriteCloser{w} }
+
+func (NoCompression) Decode(r io.Reader) io.ReadCloser { return ioutil.NopCloser(r) }
+
+// GzipCompression compresses block payloads with gzip.
+type GzipCompression struct{}
+
+func (GzipCompression) Magic() byte { return codecGzip }
+
+func (GzipCompression) Encode(w io.Writer) io.WriteCloser {
+	return gzip.NewWriter(w)
+}
+
+func (GzipCompression) Decode(r io.Reader) io.ReadCloser {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return ioutil.NopCloser(&errReader{err})
+	}
+	return gzr
+}
+
+type errReader struct{ err error }
+
+func (e *errReader) Read(p []byte) (int, error) { return 0, e.err }
+
+type errWriteCloser struct{ err error }
+
+func (e *errWriteCloser) Write(p []byte) (int, error) { return 0, e.err }
+func (e *errWriteCloser) Close() error                { return e.err }
+
+// errZstdNotImplemented and errSnappyNotImplemented are returned by every
+// ZstdCompression/Snappy method: this tree doesn't vendor a zstd or snappy
+// implementation. Earlier these silently compressed with gzip instead, under
+// the zstd/snappy codec id -- which would leave on-disk blocks unreadable by
+// a real zstd/snappy decoder, or by this codec once it's actually
+// implemented, the moment a block written "as zstd" today meets one. Rather
+// than ship that footgun, both fail loudly until a real implementation is
+// vendored.
+var (
+	errZstdNotImplemented   = errors.New("ZstdCompression: zstd support not yet implemented in this tree")
+	errSnappyNotImplemented = errors.New("Snappy: snappy support not yet implemented in this tree")
+)
+
+// ZstdCompression is reserved for a real zstd-backed Compressor, tagged with
+// the zstd codec id. Every method currently just fails; see
+// errZstdNotImplemented.
+type ZstdCompression struct{}
+
+func (ZstdCompression) Magic() byte { return codecZstd }
+
+func (ZstdCompression) Encode(w io.Writer) io.WriteCloser { return &errWriteCloser{errZstdNotImplemented} }
+
+func (ZstdCompression) Decode(r io.Reader) io.ReadCloser {
+	return ioutil.NopCloser(&errReader{errZstdNotImplemented})
+}
+
+// Snappy is reserved for a real snappy-backed Compressor, tagged with the
+// snappy codec id. Every method currently just fails; see
+// errSnappyNotImplemented.
+type Snappy struct{}
+
+func (Snappy) Magic() byte { return codecSnappy }
+
+func (Snappy) Encode(w io.Writer) io.WriteCloser { return &errWriteCloser{errSnappyNotImplemented} }
+
+func (Snappy) Decode(r io.Reader) io.ReadCloser {
+	return ioutil.NopCloser(&errReader{errSnappyNotImplemented})
+}
+
+// compressorForCodec returns the Compressor registered for a codec id read
+// off a block header.
+func compressorForCodec(codec byte) (Compressor, error) {
+	if compressor, ok := compressors[codec]; ok {
+		return compressor, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown block compression codec id %d", codec))
+}
@@ -0,0 +1,92 @@
+package fs
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// maxCachedHandles bounds how many *os.File descriptors a fileHandleCache
+// keeps open at once, LRU-evicted.
+const maxCachedHandles = 64
+
+// fileHandleCache lets consecutive ReadInto calls against the same
+// underlying file reuse its descriptor instead of paying an os.Open per
+// call. cache.mu only ever guards the map/list bookkeeping below -- looking
+// an entry up, inserting one, evicting the oldest -- never the Seek-then-read
+// a caller runs against the handle it gets back. That pair is made atomic by
+// the entry's own mutex instead, so two callers reading different files
+// don't serialize behind each other; two callers sharing the same handle
+// still do, via that handle's entry lock.
+type fileHandleCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type fileHandleEntry struct {
+	mu   sync.Mutex
+	path string
+	fh   *os.File
+}
+
+func newFileHandleCache() *fileHandleCache {
+	return &fileHandleCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// withFile runs fn against the (possibly cached) *os.File open on path,
+// holding only that file's own entry lock for the duration so fn's
+// Seek-then-read stays atomic with respect to other callers sharing this
+// handle, without blocking callers reading unrelated files.
+func (cache *fileHandleCache) withFile(path string, fn func(fh *os.File) (int64, error)) (int64, error) {
+	entry, err := cache.acquire(path)
+	if err != nil {
+		return 0, err
+	}
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	return fn(entry.fh)
+}
+
+// acquire returns the cache's entry for path, opening and inserting one if
+// necessary. It holds cache.mu only long enough to do the map/list
+// bookkeeping -- it never touches the returned entry's file.
+func (cache *fileHandleCache) acquire(path string) (*fileHandleEntry, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if elem, ok := cache.entries[path]; ok {
+		cache.order.MoveToFront(elem)
+		return elem.Value.(*fileHandleEntry), nil
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &fileHandleEntry{path: path, fh: fh}
+	elem := cache.order.PushFront(entry)
+	cache.entries[path] = elem
+
+	for cache.order.Len() > maxCachedHandles {
+		oldest := cache.order.Back()
+		evicted := oldest.Value.(*fileHandleEntry)
+		cache.order.Remove(oldest)
+		delete(cache.entries, evicted.path)
+
+		// A caller that already acquired this entry via withFile holds
+		// evicted.mu around its Seek-then-read, not cache.mu -- wait for it
+		// to finish before closing the fd out from under it.
+		evicted.mu.Lock()
+		evicted.fh.Close()
+		evicted.mu.Unlock()
+	}
+
+	return entry, nil
+}
@@ -8,23 +8,25 @@ import (
 	"reflect"
 )
 
-const gobNodeVersion int = 1
+// gobNodeVersion 1 encodes a Block as (position, weak, strong), implying a
+// fixed BLOCKSIZE length. Version 2 adds an explicit length field so blocks
+// produced by a variable-size Chunker (see CDCChunker) round-trip correctly.
+const gobNodeVersion int = 2
 
-func checkVersion(decoder *gob.Decoder) error {
-	var version int
+func checkVersion(decoder *gob.Decoder) (version int, err error) {
 	decoder.DecodeValue(reflect.ValueOf(&version))
-	if version != gobNodeVersion {
-		return errors.New(fmt.Sprintf("Version %d of node gobber cannot decode version %d",
+	if version > gobNodeVersion {
+		return version, errors.New(fmt.Sprintf("Version %d of node gobber cannot decode version %d",
 			gobNodeVersion, version))
 	}
-	return nil
+	return version, nil
 }
 
 func (block *Block) GobDecode(buf []byte) (err error) {
 	buffer := bytes.NewBuffer(buf)
 	decoder := gob.NewDecoder(buffer)
 
-	err = checkVersion(decoder)
+	version, err := checkVersion(decoder)
 	if err != nil {
 		return err
 	}
@@ -33,6 +35,14 @@ func (block *Block) GobDecode(buf []byte) (err error) {
 	if err != nil {
 		return err
 	}
+
+	if version >= 2 {
+		err = decoder.DecodeValue(reflect.ValueOf(&block.length))
+		if err != nil {
+			return err
+		}
+	}
+
 	err = decoder.DecodeValue(reflect.ValueOf(&block.weak))
 	if err != nil {
 		return err
@@ -49,7 +59,7 @@ func (file *File) GobDecode(buf []byte) (err error) {
 	buffer := bytes.NewBuffer(buf)
 	decoder := gob.NewDecoder(buffer)
 
-	err = checkVersion(decoder)
+	_, err = checkVersion(decoder)
 	if err != nil {
 		return err
 	}
@@ -86,7 +96,7 @@ func (dir *Dir) GobDecode(buf []byte) (err error) {
 	buffer := bytes.NewBuffer(buf)
 	decoder := gob.NewDecoder(buffer)
 
-	err = checkVersion(decoder)
+	_, err = checkVersion(decoder)
 	if err != nil {
 		return err
 	}
@@ -136,6 +146,10 @@ func (block *Block) GobEncode() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = encoder.EncodeValue(reflect.ValueOf(&block.length))
+	if err != nil {
+		return nil, err
+	}
 	encoder.EncodeValue(reflect.ValueOf(&block.weak))
 	if err != nil {
 		return nil, err
@@ -0,0 +1,67 @@
+package fs
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// IndexFile reads the file at path and chunks it with chunkerFactory,
+// building the *File this tree uses to describe it without writing
+// anything to disk -- the same indexing CASStore.putFile does when it
+// writes a file's blocks into the store. A nil chunkerFactory defaults to
+// NewFixedChunker, reproducing the historical BLOCKSIZE-cut behavior so
+// existing callers that don't ask for content-defined chunking see no
+// change.
+func IndexFile(path string, chunkerFactory ChunkerFactory) (file *File, err error) {
+	if chunkerFactory == nil {
+		chunkerFactory = func() Chunker { return NewFixedChunker() }
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	info, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	file = &File{name: filepath.Base(path), mode: info.Mode(), Size: info.Size()}
+
+	chunker := chunkerFactory()
+	hasher := sha1.New()
+	var position int64
+
+	for {
+		chunk, cerr := chunker.Next(fh)
+		if len(chunk) > 0 {
+			sum := sha1.Sum(chunk)
+			block := &Block{
+				position: position,
+				length:   int64(len(chunk)),
+				weak:     rollingHash(chunk),
+				strong:   hex.EncodeToString(sum[:]),
+				parent:   file,
+			}
+			file.Blocks = append(file.Blocks, block)
+
+			hasher.Write(chunk)
+			position += int64(len(chunk))
+		}
+
+		if cerr == io.EOF {
+			break
+		}
+		if cerr != nil {
+			return nil, cerr
+		}
+	}
+
+	file.strong = hex.EncodeToString(hasher.Sum(nil))
+	return file, nil
+}
@@ -0,0 +1,319 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gob"
+	"os"
+)
+
+// Explicit wire schema for filesystem nodes, independent of how any
+// particular NodeCodec serializes them. Fields are optional so new metadata
+// (mtime, uid/gid, xattrs, a symlink target, ...) can be added later without
+// breaking codecs that don't know about it yet.
+type PBBlock struct {
+	Position int64
+	Length   int64
+	Weak     uint32
+	Strong   string
+}
+
+type PBFile struct {
+	Name   string
+	Mode   uint32
+	Strong string
+	Size   int64
+	Blocks []PBBlock
+}
+
+type PBDir struct {
+	Name    string
+	Mode    uint32
+	Strong  string
+	SubDirs []PBDir
+	Files   []PBFile
+}
+
+func toPBBlock(block *Block) PBBlock {
+	return PBBlock{Position: block.position, Length: block.length, Weak: block.weak, Strong: block.strong}
+}
+
+func fromPBBlock(pb PBBlock, parent *File) *Block {
+	return &Block{position: pb.Position, length: pb.Length, weak: pb.Weak, strong: pb.Strong, parent: parent}
+}
+
+func toPBFile(file *File) PBFile {
+	pb := PBFile{Name: file.name, Mode: uint32(file.mode), Strong: file.strong, Size: file.Size}
+	for _, block := range file.Blocks {
+		pb.Blocks = append(pb.Blocks, toPBBlock(block))
+	}
+	return pb
+}
+
+func fromPBFile(pb PBFile) *File {
+	file := &File{name: pb.Name, mode: os.FileMode(pb.Mode), strong: pb.Strong, Size: pb.Size}
+	for _, pbBlock := range pb.Blocks {
+		file.Blocks = append(file.Blocks, fromPBBlock(pbBlock, file))
+	}
+	return file
+}
+
+func toPBDir(dir *Dir) PBDir {
+	pb := PBDir{Name: dir.name, Mode: uint32(dir.mode), Strong: dir.strong}
+	for _, subdir := range dir.SubDirs {
+		pb.SubDirs = append(pb.SubDirs, toPBDir(subdir))
+	}
+	for _, file := range dir.Files {
+		pb.Files = append(pb.Files, toPBFile(file))
+	}
+	return pb
+}
+
+func fromPBDir(pb PBDir) *Dir {
+	dir := &Dir{name: pb.Name, mode: os.FileMode(pb.Mode), strong: pb.Strong}
+	for _, pbSub := range pb.SubDirs {
+		subdir := fromPBDir(pbSub)
+		subdir.parent = dir
+		dir.SubDirs = append(dir.SubDirs, subdir)
+	}
+	for _, pbFile := range pb.Files {
+		file := fromPBFile(pbFile)
+		file.parent = dir
+		dir.Files = append(dir.Files, file)
+	}
+	return dir
+}
+
+// NodeCodec serializes and deserializes filesystem nodes (Block, File,
+// Dir). EncodeBlockWith/EncodeFileWith/EncodeDirWith prefix every blob a
+// NodeCodec produces with its 1-byte Magic (the codec's own Encode methods
+// return the bare body), so DecodeBlock/DecodeFile/DecodeDir can
+// auto-detect which codec wrote a given blob instead of a single global
+// version hard-failing on mismatch.
+type NodeCodec interface {
+	Magic() byte
+
+	EncodeBlock(block *Block) ([]byte, error)
+	EncodeFile(file *File) ([]byte, error)
+	EncodeDir(dir *Dir) ([]byte, error)
+
+	decodeBlock(data []byte) (*Block, error)
+	decodeFile(data []byte) (*File, error)
+	decodeDir(data []byte) (*Dir, error)
+}
+
+const (
+	codecMagicGob byte = iota + 1
+	codecMagicJSON
+	codecMagicProto
+)
+
+var nodeCodecs = map[byte]NodeCodec{}
+
+// RegisterNodeCodec makes a NodeCodec available to DecodeBlock/DecodeFile/
+// DecodeDir by its magic byte.
+func RegisterNodeCodec(codec NodeCodec) {
+	nodeCodecs[codec.Magic()] = codec
+}
+
+func init() {
+	RegisterNodeCodec(GobCodec{})
+	RegisterNodeCodec(JSONCodec{})
+	// ProtoCodec is deliberately not registered: it doesn't speak protobuf
+	// (see its doc comment), and registering it would let DecodeBlock/
+	// DecodeFile/DecodeDir dispatch real protobuf-tagged blobs from a
+	// future implementation into code that can't read them.
+}
+
+// EncodeBlockWith, EncodeFileWith and EncodeDirWith serialize a node with
+// the given codec, prepending its magic byte so DecodeBlock/DecodeFile/
+// DecodeDir can recognize it later regardless of which codec is configured
+// at decode time.
+func EncodeBlockWith(codec NodeCodec, block *Block) ([]byte, error) {
+	body, err := codec.EncodeBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codec.Magic()}, body...), nil
+}
+
+func EncodeFileWith(codec NodeCodec, file *File) ([]byte, error) {
+	body, err := codec.EncodeFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codec.Magic()}, body...), nil
+}
+
+func EncodeDirWith(codec NodeCodec, dir *Dir) ([]byte, error) {
+	body, err := codec.EncodeDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{codec.Magic()}, body...), nil
+}
+
+// isLegacyGobNode reports whether data is a pre-NodeCodec node blob: the raw
+// gobNodeVersion wire format from gob.go, with no magic byte prefix at all.
+// It can't be told apart from a magic-prefixed blob by convention alone --
+// gob's own length-prefixed encoding of a lone int can begin with almost
+// any byte depending on the encoded value, and happens to collide with
+// codecMagicProto for both gobNodeVersion 1 and 2 -- so detection is
+// structural: trial-decode the leading gob value and check it's a version
+// checkVersion (see gob.go) would accept.
+func isLegacyGobNode(data []byte) (isLegacy bool) {
+	defer func() {
+		if recover() != nil {
+			isLegacy = false
+		}
+	}()
+
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	version, err := checkVersion(decoder)
+	return err == nil && version >= 1 && version <= gobNodeVersion
+}
+
+// DecodeBlock, DecodeFile and DecodeDir first check for the legacy,
+// unprefixed gobNodeVersion format (see isLegacyGobNode) so existing
+// on-disk indexes keep working untouched, then dispatch on data's leading
+// magic byte to the NodeCodec that produced it.
+func DecodeBlock(data []byte) (*Block, error) {
+	if len(data) == 0 {
+		return nil, errors.New("DecodeBlock: empty node blob")
+	}
+
+	if isLegacyGobNode(data) {
+		block := &Block{}
+		return block, block.GobDecode(data)
+	}
+
+	if codec, ok := nodeCodecs[data[0]]; ok {
+		return codec.decodeBlock(data[1:])
+	}
+
+	return nil, errors.New(fmt.Sprintf("DecodeBlock: unrecognized node codec magic byte 0x%x", data[0]))
+}
+
+func DecodeFile(data []byte) (*File, error) {
+	if len(data) == 0 {
+		return nil, errors.New("DecodeFile: empty node blob")
+	}
+
+	if isLegacyGobNode(data) {
+		file := &File{}
+		return file, file.GobDecode(data)
+	}
+
+	if codec, ok := nodeCodecs[data[0]]; ok {
+		return codec.decodeFile(data[1:])
+	}
+
+	return nil, errors.New(fmt.Sprintf("DecodeFile: unrecognized node codec magic byte 0x%x", data[0]))
+}
+
+func DecodeDir(data []byte) (*Dir, error) {
+	if len(data) == 0 {
+		return nil, errors.New("DecodeDir: empty node blob")
+	}
+
+	if isLegacyGobNode(data) {
+		dir := &Dir{}
+		return dir, dir.GobDecode(data)
+	}
+
+	if codec, ok := nodeCodecs[data[0]]; ok {
+		return codec.decodeDir(data[1:])
+	}
+
+	return nil, errors.New(fmt.Sprintf("DecodeDir: unrecognized node codec magic byte 0x%x", data[0]))
+}
+
+// GobCodec wraps the legacy gobNodeVersion wire format from gob.go behind
+// the NodeCodec interface, now with a magic byte prefix like every other
+// codec. It remains the default: old writes without any magic prefix are
+// handled directly by DecodeBlock/DecodeFile/DecodeDir's fallback path
+// above, since stripping a non-existent magic byte isn't needed to make
+// sense of them.
+type GobCodec struct{}
+
+func (GobCodec) Magic() byte { return codecMagicGob }
+
+func (GobCodec) EncodeBlock(block *Block) ([]byte, error) { return block.GobEncode() }
+func (GobCodec) EncodeFile(file *File) ([]byte, error)     { return file.GobEncode() }
+func (GobCodec) EncodeDir(dir *Dir) ([]byte, error)        { return dir.GobEncode() }
+
+func (GobCodec) decodeBlock(data []byte) (*Block, error) {
+	block := &Block{}
+	return block, block.GobDecode(data)
+}
+
+func (GobCodec) decodeFile(data []byte) (*File, error) {
+	file := &File{}
+	return file, file.GobDecode(data)
+}
+
+func (GobCodec) decodeDir(data []byte) (*Dir, error) {
+	dir := &Dir{}
+	return dir, dir.GobDecode(data)
+}
+
+// JSONCodec serializes nodes as JSON against the PBBlock/PBFile/PBDir wire
+// schema, so a non-Go client can read a replican index without implementing
+// Go's gob format.
+type JSONCodec struct{}
+
+func (JSONCodec) Magic() byte { return codecMagicJSON }
+
+func (JSONCodec) EncodeBlock(block *Block) ([]byte, error) { return json.Marshal(toPBBlock(block)) }
+func (JSONCodec) EncodeFile(file *File) ([]byte, error)     { return json.Marshal(toPBFile(file)) }
+func (JSONCodec) EncodeDir(dir *Dir) ([]byte, error)        { return json.Marshal(toPBDir(dir)) }
+
+func (JSONCodec) decodeBlock(data []byte) (*Block, error) {
+	var pb PBBlock
+	if err := json.Unmarshal(data, &pb); err != nil {
+		return nil, err
+	}
+	return fromPBBlock(pb, nil), nil
+}
+
+func (JSONCodec) decodeFile(data []byte) (*File, error) {
+	var pb PBFile
+	if err := json.Unmarshal(data, &pb); err != nil {
+		return nil, err
+	}
+	return fromPBFile(pb), nil
+}
+
+func (JSONCodec) decodeDir(data []byte) (*Dir, error) {
+	var pb PBDir
+	if err := json.Unmarshal(data, &pb); err != nil {
+		return nil, err
+	}
+	return fromPBDir(pb), nil
+}
+
+// errProtoNotImplemented is returned by every ProtoCodec method: this tree
+// has no vendored protobuf runtime (no go.mod, no protoc-gen-go) to encode
+// or decode the PBBlock/PBFile/PBDir messages the request calls for. Rather
+// than emit JSON under the reserved protobuf codec id -- which would make
+// every block written "as proto" today unreadable by a real protobuf
+// consumer, or by this codec once it's actually implemented -- ProtoCodec
+// fails loudly and is left unregistered (see init) until that's done.
+var errProtoNotImplemented = errors.New("ProtoCodec: protobuf support not yet implemented in this tree")
+
+// ProtoCodec is reserved for an implementation against the PBBlock/PBFile/
+// PBDir wire schema using real protobuf encoding. It claims codecMagicProto
+// but every method currently just fails; see errProtoNotImplemented.
+type ProtoCodec struct{}
+
+func (ProtoCodec) Magic() byte { return codecMagicProto }
+
+func (ProtoCodec) EncodeBlock(block *Block) ([]byte, error) { return nil, errProtoNotImplemented }
+func (ProtoCodec) EncodeFile(file *File) ([]byte, error)     { return nil, errProtoNotImplemented }
+func (ProtoCodec) EncodeDir(dir *Dir) ([]byte, error)        { return nil, errProtoNotImplemented }
+
+func (ProtoCodec) decodeBlock(data []byte) (*Block, error) { return nil, errProtoNotImplemented }
+func (ProtoCodec) decodeFile(data []byte) (*File, error)   { return nil, errProtoNotImplemented }
+func (ProtoCodec) decodeDir(data []byte) (*Dir, error)     { return nil, errProtoNotImplemented }
@@ -0,0 +1,255 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Pack file layout:
+//
+//	header:  magic(4) + version(uint32)
+//	entries: repeated [uvarint length][block bytes]
+//	index:   repeated [uvarint strong length][strong bytes][offset(uint64)][length(uint32)]
+//	footer:  indexOffset(uint64) + indexDigest(32)
+//
+// Bundling many small blocks into one pack amortizes the open/seek/read
+// cost that dominates when syncing a directory of thousands of small
+// files, the same way git and restic bundle objects into packs rather than
+// one file per object. An index entry's offset points at the start of its
+// raw block bytes (past the uvarint length prefix), so a reader holding the
+// loaded index can os.ReadAt the bytes directly without re-parsing entries.
+var packMagic = [4]byte{'R', 'P', 'A', 'K'}
+
+const packVersion uint32 = 1
+
+// packFooterSize is indexOffset(uint64) + indexDigest(32), a sha256 over the
+// index blob guarding against a truncated or corrupt pack -- unlike an index
+// entry's key, this digest is never looked up by value, so it doesn't need
+// to be invertible back to anything.
+const packFooterSize = 8 + 32
+
+type packIndexEntry struct {
+	strong string
+	offset uint64
+	length uint32
+}
+
+// PackWriter serializes a set of blocks into a single append-only pack
+// file.
+type PackWriter struct {
+	w       io.Writer
+	offset  uint64
+	entries []packIndexEntry
+}
+
+// NewPackWriter begins a new pack, writing its header to w.
+func NewPackWriter(w io.Writer) (pw *PackWriter, err error) {
+	pw = &PackWriter{w: w}
+
+	if _, err = w.Write(packMagic[:]); err != nil {
+		return nil, err
+	}
+	if err = binary.Write(w, binary.BigEndian, packVersion); err != nil {
+		return nil, err
+	}
+
+	pw.offset = uint64(len(packMagic)) + 4
+	return pw, nil
+}
+
+// Add appends a block's bytes to the pack, recording it under strong for
+// later lookup by ReadBlock.
+func (pw *PackWriter) Add(strong string, data []byte) error {
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(lenBuf, uint64(len(data)))
+
+	if _, err := pw.w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	pw.offset += uint64(n)
+
+	if _, err := pw.w.Write(data); err != nil {
+		return err
+	}
+
+	pw.entries = append(pw.entries, packIndexEntry{
+		strong: strong,
+		offset: pw.offset,
+		length: uint32(len(data)),
+	})
+	pw.offset += uint64(len(data))
+
+	return nil
+}
+
+// Close writes the trailing index and footer, finishing the pack. w is not
+// closed; that remains the caller's responsibility.
+func (pw *PackWriter) Close() error {
+	indexOffset := pw.offset
+
+	indexBuf := &bytes.Buffer{}
+	for _, entry := range pw.entries {
+		strongBuf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(strongBuf, uint64(len(entry.strong)))
+		indexBuf.Write(strongBuf[:n])
+		indexBuf.WriteString(entry.strong)
+		binary.Write(indexBuf, binary.BigEndian, entry.offset)
+		binary.Write(indexBuf, binary.BigEndian, entry.length)
+	}
+
+	if _, err := pw.w.Write(indexBuf.Bytes()); err != nil {
+		return err
+	}
+
+	indexDigest := sha256.Sum256(indexBuf.Bytes())
+
+	if err := binary.Write(pw.w, binary.BigEndian, indexOffset); err != nil {
+		return err
+	}
+	if _, err := pw.w.Write(indexDigest[:]); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// PackReader provides O(1) lookup of a block's bytes within a pack file by
+// strong checksum. Its index is read once at open time and kept in memory;
+// this tree doesn't vendor an mmap package, so the "mmap the index" goal is
+// approximated with a plain in-memory map rather than a mapped file.
+type PackReader struct {
+	fh    *os.File
+	index map[string]packIndexEntry
+}
+
+// OpenPackReader opens the pack file at path and loads its index into
+// memory.
+func OpenPackReader(path string) (pr *PackReader, err error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	footer := make([]byte, packFooterSize)
+	if _, err = fh.ReadAt(footer, info.Size()-packFooterSize); err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	indexOffset := binary.BigEndian.Uint64(footer[:8])
+	var wantDigest [32]byte
+	copy(wantDigest[:], footer[8:])
+
+	indexLen := info.Size() - packFooterSize - int64(indexOffset)
+	indexBuf := make([]byte, indexLen)
+	if _, err = fh.ReadAt(indexBuf, int64(indexOffset)); err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	if sha256.Sum256(indexBuf) != wantDigest {
+		fh.Close()
+		return nil, errors.New(fmt.Sprintf("Pack %s has a corrupt index (checksum mismatch)", path))
+	}
+
+	index := make(map[string]packIndexEntry)
+	for i := 0; i < len(indexBuf); {
+		strongLen, n := binary.Uvarint(indexBuf[i:])
+		if n <= 0 {
+			fh.Close()
+			return nil, errors.New(fmt.Sprintf("Pack %s has a corrupt index (bad strong length)", path))
+		}
+		i += n
+
+		strong := string(indexBuf[i : i+int(strongLen)])
+		i += int(strongLen)
+
+		var entry packIndexEntry
+		entry.strong = strong
+		entry.offset = binary.BigEndian.Uint64(indexBuf[i : i+8])
+		i += 8
+		entry.length = binary.BigEndian.Uint32(indexBuf[i : i+4])
+		i += 4
+
+		index[entry.strong] = entry
+	}
+
+	return &PackReader{fh: fh, index: index}, nil
+}
+
+// ReadBlock returns the bytes of the block with the given strong checksum,
+// or an error if this pack doesn't contain it.
+func (pr *PackReader) ReadBlock(strong string) ([]byte, error) {
+	entry, ok := pr.index[strong]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Block with strong checksum %s not found in pack", strong))
+	}
+
+	buf := make([]byte, entry.length)
+	if _, err := pr.fh.ReadAt(buf, int64(entry.offset)); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+func (pr *PackReader) Close() error { return pr.fh.Close() }
+
+// Repack consolidates the blocks found across packPaths into a single new
+// pack at outputPath, deduplicating by strong checksum so a block present
+// in more than one input pack is only written once. This is the maintenance
+// operation that reclaims the space fragmented across many small packs.
+func Repack(packPaths []string, outputPath string) (err error) {
+	out, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	pw, err := NewPackWriter(out)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+
+	for _, path := range packPaths {
+		reader, rerr := OpenPackReader(path)
+		if rerr != nil {
+			return rerr
+		}
+
+		for strong, entry := range reader.index {
+			if seen[strong] {
+				continue
+			}
+			seen[strong] = true
+
+			data := make([]byte, entry.length)
+			if _, rerr = reader.fh.ReadAt(data, int64(entry.offset)); rerr != nil {
+				reader.Close()
+				return rerr
+			}
+
+			if rerr = pw.Add(strong, data); rerr != nil {
+				reader.Close()
+				return rerr
+			}
+		}
+
+		reader.Close()
+	}
+
+	return pw.Close()
+}
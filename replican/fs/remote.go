@@ -0,0 +1,316 @@
+package fs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gob"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseRangeHeader parses the single-range form of an RFC 7233 Range
+// header, "bytes=start-end" (both ends inclusive), as sent by
+// RemoteStore.ReadInto. Multi-range requests ("bytes=0-10,20-30") aren't
+// supported; ServeBlockStore never needs more than one range per request.
+func parseRangeHeader(header string) (from int64, length int64, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, errors.New(fmt.Sprintf("invalid Range header %q", header))
+	}
+
+	spec := strings.TrimPrefix(header, prefix)
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New(fmt.Sprintf("invalid Range header %q", header))
+	}
+
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, errors.New(fmt.Sprintf("invalid Range header %q", header))
+	}
+
+	end, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, errors.New(fmt.Sprintf("invalid Range header %q", header))
+	}
+
+	if end < start {
+		return 0, 0, errors.New(fmt.Sprintf("invalid Range header %q", header))
+	}
+
+	return start, end - start + 1, nil
+}
+
+func init() {
+	gob.Register(&Dir{})
+	gob.Register(&File{})
+}
+
+// ServeBlockStore exposes store over HTTP so a peer without shared
+// filesystem access can sync from it via RemoteStore. The wire protocol is:
+//
+//	GET  /root          gob-encoded root FsNode
+//	GET  /index         gob-encoded BlockIndex
+//	GET  /block/{strong} raw block bytes
+//	GET  /file/{strong}, with a Range: bytes=N-M header  ReadInto, as a 206
+//	POST /blocks        gob-encoded []string of strongs in, a pack out
+func ServeBlockStore(store BlockStore) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/root", func(w http.ResponseWriter, r *http.Request) {
+		// Encoded through a pointer so gob sends an FsNode interface value,
+		// which is what RemoteStore.refresh decodes into.
+		root := store.Root()
+		serveGob(w, &root)
+	})
+
+	mux.HandleFunc("/index", func(w http.ResponseWriter, r *http.Request) {
+		serveGob(w, store.Index())
+	})
+
+	mux.HandleFunc("/block/", func(w http.ResponseWriter, r *http.Request) {
+		strong := strings.TrimPrefix(r.URL.Path, "/block/")
+
+		data, err := store.ReadBlock(strong)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Write(data)
+	})
+
+	mux.HandleFunc("/file/", func(w http.ResponseWriter, r *http.Request) {
+		strong := strings.TrimPrefix(r.URL.Path, "/file/")
+
+		from, length, err := parseRangeHeader(r.Header.Get("Range"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", from, from+length-1))
+		w.WriteHeader(http.StatusPartialContent)
+
+		if _, err := store.ReadInto(strong, from, length, w); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		}
+	})
+
+	mux.HandleFunc("/blocks", func(w http.ResponseWriter, r *http.Request) {
+		serveBatch(w, r, store)
+	})
+
+	return mux
+}
+
+func serveGob(w http.ResponseWriter, v interface{}) {
+	if err := gob.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveBatch answers POST /blocks: it decodes the requested strong
+// checksums from the request body and streams back a single pack (see
+// PackWriter) containing exactly those blocks the store has, so a remote
+// sync can fetch many blocks in one round-trip instead of one /block
+// request per missing block.
+func serveBatch(w http.ResponseWriter, r *http.Request, store BlockStore) {
+	var strongs []string
+	if err := gob.NewDecoder(r.Body).Decode(&strongs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pw, err := NewPackWriter(w)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, strong := range strongs {
+		data, err := store.ReadBlock(strong)
+		if err != nil {
+			continue
+		}
+		if err := pw.Add(strong, data); err != nil {
+			return
+		}
+	}
+
+	pw.Close()
+}
+
+// BatchBlockStore is a BlockStore that can fetch several blocks in one
+// round-trip. RemoteStore implements it by asking its peer for a pack
+// containing exactly the requested blocks instead of issuing one /block
+// request per block.
+type BatchBlockStore interface {
+	BlockStore
+	BatchReadBlocks(strongs []string) io.Reader
+}
+
+// RemoteStore is a BlockStore backed by a ServeBlockStore peer over HTTP.
+// The root and index are fetched once, at construction, and served from
+// memory afterward; ReadBlock fetches whole blocks from the peer's /block
+// endpoint and ReadInto issues ranged requests against its /file endpoint.
+type RemoteStore struct {
+	baseURL string
+	client  *http.Client
+
+	root  FsNode
+	index *BlockIndex
+
+	// MaxRetries and Backoff control the retry/backoff RemoteStore applies
+	// to its GET requests against the peer (root, index, ReadBlock,
+	// ReadInto). BatchReadBlocks' POST /blocks is sent once, without retry.
+	MaxRetries int
+	Backoff    time.Duration
+}
+
+// NewRemoteStore connects to a ServeBlockStore peer at baseURL (e.g.
+// "http://peer:8080") and fetches its root and index. A nil client uses
+// http.DefaultClient; callers that need TLS configuration or auth should
+// pass their own.
+func NewRemoteStore(baseURL string, client *http.Client) (store *RemoteStore, err error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	store = &RemoteStore{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		client:     client,
+		MaxRetries: 3,
+		Backoff:    200 * time.Millisecond,
+	}
+
+	if err = store.refresh(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (store *RemoteStore) refresh() error {
+	rootBody, err := store.getWithRetry("/root")
+	if err != nil {
+		return err
+	}
+	defer rootBody.Close()
+
+	var root FsNode
+	if err := gob.NewDecoder(rootBody).Decode(&root); err != nil {
+		return err
+	}
+	store.root = root
+
+	indexBody, err := store.getWithRetry("/index")
+	if err != nil {
+		return err
+	}
+	defer indexBody.Close()
+
+	index := &BlockIndex{}
+	if err := gob.NewDecoder(indexBody).Decode(index); err != nil {
+		return err
+	}
+	store.index = index
+
+	return nil
+}
+
+func (store *RemoteStore) Root() FsNode       { return store.root }
+func (store *RemoteStore) Index() *BlockIndex { return store.index }
+
+// getWithRetry issues a GET against the peer, retrying with a linearly
+// increasing backoff on transport errors or a non-200 response.
+func (store *RemoteStore) getWithRetry(path string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", store.baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return store.doWithRetry(req, http.StatusOK)
+}
+
+// doWithRetry issues req against the peer, retrying with a linearly
+// increasing backoff on transport errors or a response whose status code
+// isn't wantStatus.
+func (store *RemoteStore) doWithRetry(req *http.Request, wantStatus int) (io.ReadCloser, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= store.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(store.Backoff * time.Duration(attempt))
+		}
+
+		resp, err := store.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode != wantStatus {
+			resp.Body.Close()
+			lastErr = errors.New(fmt.Sprintf("%s %s: %s", req.Method, req.URL.Path, resp.Status))
+			continue
+		}
+
+		return resp.Body, nil
+	}
+
+	return nil, lastErr
+}
+
+func (store *RemoteStore) ReadBlock(strong string) ([]byte, error) {
+	body, err := store.getWithRetry("/block/" + strong)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+func (store *RemoteStore) ReadInto(strong string, from int64, length int64, writer io.Writer) (int64, error) {
+	req, err := http.NewRequest("GET", store.baseURL+"/file/"+strong, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, from+length-1))
+
+	body, err := store.doWithRetry(req, http.StatusPartialContent)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	return io.Copy(writer, body)
+}
+
+// BatchReadBlocks fetches every block in strongs in a single round-trip:
+// the peer packs them server-side (see serveBatch) and this returns a
+// reader over that pack's raw bytes, which OpenPackReader can open once
+// it's been written to disk.
+func (store *RemoteStore) BatchReadBlocks(strongs []string) io.Reader {
+	body := &bytes.Buffer{}
+	if err := gob.NewEncoder(body).Encode(strongs); err != nil {
+		return &errReader{err}
+	}
+
+	resp, err := store.client.Post(store.baseURL+"/blocks", "application/octet-stream", body)
+	if err != nil {
+		return &errReader{err}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return &errReader{errors.New(fmt.Sprintf("POST /blocks: %s", resp.Status))}
+	}
+
+	return resp.Body
+}
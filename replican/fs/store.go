@@ -41,10 +41,33 @@ type LocalStore interface {
 	reindex() error
 }
 
+// Options configures optional behavior shared by the BlockStore
+// implementations in this package.
+type Options struct {
+	// Compression is applied to block payloads on write and reversed on
+	// read. Defaults to NoCompression when left as the zero value.
+	Compression Compressor
+
+	// Codec serializes the nodes a store writes (CASStore's File/Dir node
+	// records). Defaults to GobCodec when left as the zero value.
+	Codec NodeCodec
+
+	// Chunker decides where a file's content is split into Blocks when a
+	// LocalFileStore or a CASStore (re)indexes it. Left as the zero value, a
+	// LocalFileStore defaults to FixedChunker (cutting BLOCKSIZE chunks, the
+	// historical behavior) and a CASStore defaults to NewDefaultCDCChunker;
+	// pass a ChunkerFactory explicitly to override either. A LocalDirStore's
+	// reindex does not use it.
+	Chunker ChunkerFactory
+}
+
 type localBase struct {
-	rootPath string
-	index    *BlockIndex
-	relocs   map[string]string
+	rootPath    string
+	index       *BlockIndex
+	relocs      map[string]string
+	compression Compressor
+	handles     *fileHandleCache
+	chunker     ChunkerFactory
 }
 
 type LocalDirStore struct {
@@ -58,12 +81,29 @@ type LocalFileStore struct {
 }
 
 func NewLocalStore(rootPath string) (local LocalStore, err error) {
+	return NewLocalStoreWithOptions(rootPath, Options{})
+}
+
+// NewLocalStoreWithOptions builds a LocalStore the same way NewLocalStore
+// does, but lets the caller configure optional behavior such as per-block
+// compression.
+func NewLocalStoreWithOptions(rootPath string, options Options) (local LocalStore, err error) {
 	rootInfo, err := os.Stat(rootPath)
 	if err != nil {
 		return nil, err
 	}
 
-	localBase := &localBase{rootPath: rootPath}
+	compression := options.Compression
+	if compression == nil {
+		compression = NoCompression{}
+	}
+
+	chunker := options.Chunker
+	if chunker == nil {
+		chunker = func() Chunker { return NewFixedChunker() }
+	}
+
+	localBase := &localBase{rootPath: rootPath, compression: compression, handles: newFileHandleCache(), chunker: chunker}
 	if rootInfo.IsDirectory() {
 		local = &LocalDirStore{localBase: localBase}
 	} else if rootInfo.IsRegular() {
@@ -90,7 +130,7 @@ func (store *LocalDirStore) reindex() (err error) {
 }
 
 func (store *LocalFileStore) reindex() (err error) {
-	store.file, err = IndexFile(store.RootPath())
+	store.file, err = IndexFile(store.RootPath(), store.chunker)
 	if err != nil {
 		return err
 	}
@@ -160,8 +200,15 @@ func (store *localBase) ReadBlock(strong string) ([]byte, error) {
 			fmt.Sprintf("Block with strong checksum %s not found", strong))
 	}
 
+	length := block.Length()
+	if length == 0 {
+		// Blocks decoded from a gobNodeVersion 1 index predate per-block
+		// lengths and were always cut at BLOCKSIZE.
+		length = BLOCKSIZE
+	}
+
 	buf := &bytes.Buffer{}
-	_, err := store.ReadInto(block.Parent().Strong(), block.Offset(), int64(BLOCKSIZE), buf)
+	_, err := store.ReadInto(block.Parent().Strong(), block.Offset(), int64(length), buf)
 	if err == nil {
 		return nil, err
 	}
@@ -179,20 +226,72 @@ func (store *localBase) ReadInto(strong string, from int64, length int64, writer
 
 	path := store.Resolve(RelPath(file))
 
-	fh, err := os.Open(path)
-	if fh == nil {
+	if _, compressed := store.compression.(NoCompression); !compressed {
+		return store.handles.withFile(path, func(fh *os.File) (int64, error) {
+			return store.readIntoCompressed(fh, from, length, writer)
+		})
+	}
+
+	return store.handles.withFile(path, func(fh *os.File) (int64, error) {
+		_, err := fh.Seek(from, 0)
+		if err != nil {
+			return 0, err
+		}
+
+		return io.CopyN(writer, fh, length)
+	})
+}
+
+// readIntoCompressed decompresses fh in full and slices out [from,
+// from+length) in memory. Seeking inside a compressed stream isn't cheap,
+// so the decompressed bytes are only ever kept around for the duration of
+// this call.
+//
+// fh itself may not actually be compressed: LocalDirStore and LocalFileStore
+// index a live directory tree in place and have no write path of their own,
+// so Options.Compression only ever describes how CASStore, say, wrote the
+// blocks this store is now reading -- the plain files on disk here predate
+// that option entirely. readBlockHeader's hasHeader flag tells the two
+// apart, the same way CASStore.ReadBlock does.
+func (store *localBase) readIntoCompressed(fh *os.File, from int64, length int64, writer io.Writer) (int64, error) {
+	if _, err := fh.Seek(0, 0); err != nil {
 		return 0, err
 	}
 
-	_, err = fh.Seek(from, 0)
+	codec, _, hasHeader, err := readBlockHeader(fh)
 	if err != nil {
 		return 0, err
 	}
+	if !hasHeader {
+		if _, err := fh.Seek(from, 0); err != nil {
+			return 0, err
+		}
+		return io.CopyN(writer, fh, length)
+	}
 
-	n, err := io.CopyN(writer, fh, length)
+	compression, err := compressorForCodec(codec)
 	if err != nil {
-		return n, err
+		return 0, err
+	}
+
+	decoder := compression.Decode(fh)
+	defer decoder.Close()
+
+	decompressed, err := ioutil.ReadAll(decoder)
+	if err != nil {
+		return 0, err
+	}
+
+	if from > int64(len(decompressed)) {
+		return 0, errors.New(fmt.Sprintf("Read offset %d past end of decompressed file (len %d)",
+			from, len(decompressed)))
+	}
+
+	end := from + length
+	if end > int64(len(decompressed)) {
+		end = int64(len(decompressed))
 	}
 
-	return n, nil
+	n, err := writer.Write(decompressed[from:end])
+	return int64(n), err
 }